@@ -0,0 +1,135 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+// Package console allocates and manages the pseudo-terminal used for a
+// container's controlling terminal, modeled on containerd's console
+// package. It gives the shim a real master/slave pty pair instead of
+// re-dup'ing fds 0-2 onto /dev/console, so that console resize and
+// detached attach both work.
+package console
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Console is a pty pair allocated for a container's controlling
+// terminal. Master is kept open by the shim for the lifetime of the
+// container; Slave is handed to the container process as its
+// stdin/stdout/stderr and closed once the child has it open.
+type Console struct {
+	Master *os.File
+	Slave  *os.File
+	path   string
+}
+
+// New opens /dev/ptmx, unlocks the pty pair and opens the slave side,
+// returning both ends ready to be wired into a container process.
+func New() (*Console, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|os.O_NOCTTY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /dev/ptmx: %s", err)
+	}
+
+	if err := unlockpt(master); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to unlock pty: %s", err)
+	}
+
+	path, err := ptsname(master)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to resolve pty slave name: %s", err)
+	}
+
+	slave, err := os.OpenFile(path, os.O_RDWR|os.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to open pty slave %s: %s", path, err)
+	}
+
+	return &Console{Master: master, Slave: slave, path: path}, nil
+}
+
+// Path returns the path of the pty slave (e.g. /dev/pts/3).
+func (c *Console) Path() string {
+	return c.path
+}
+
+// Close closes both ends of the console.
+func (c *Console) Close() error {
+	var err error
+	if e := c.Slave.Close(); e != nil {
+		err = e
+	}
+	if e := c.Master.Close(); e != nil {
+		err = e
+	}
+	return err
+}
+
+// unlockpt is the equivalent of glibc's unlockpt(3): it clears the
+// kernel lock placed on the slave side of a pty pair when the master
+// is opened via /dev/ptmx.
+func unlockpt(master *os.File) error {
+	var lock int32
+	return ioctl(master.Fd(), unix.TIOCSPTLCK, uintptr(unsafe.Pointer(&lock)))
+}
+
+// ptsname is the equivalent of glibc's ptsname(3): it resolves the
+// path of the slave side of a pty pair given its master.
+func ptsname(master *os.File) (string, error) {
+	var n int32
+	if err := ioctl(master.Fd(), unix.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		return "", err
+	}
+	return "/dev/pts/" + strconv.Itoa(int(n)), nil
+}
+
+func ioctl(fd uintptr, req uint, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(req), arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Winsize mirrors the kernel's struct winsize used by TIOCGWINSZ /
+// TIOCSWINSZ.
+type Winsize = unix.Winsize
+
+// GetWinsize reads the current window size of fd.
+func GetWinsize(fd uintptr) (*Winsize, error) {
+	return unix.IoctlGetWinsize(int(fd), unix.TIOCGWINSZ)
+}
+
+// SetWinsize applies ws to fd.
+func SetWinsize(fd uintptr, ws *Winsize) error {
+	return unix.IoctlSetWinsize(int(fd), unix.TIOCSWINSZ, ws)
+}
+
+// Proxy copies bytes bidirectionally between the console master and
+// conn until either side is closed. It is run in its own goroutine for
+// each attach connection accepted on the instance's attach socket.
+func Proxy(master *os.File, conn io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+
+	go func() {
+		io.Copy(conn, master) // nolint:errcheck
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(master, conn) // nolint:errcheck
+		done <- struct{}{}
+	}()
+
+	<-done
+	conn.Close()
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+// Package hook runs the OCI runtime-spec lifecycle hooks (Prestart,
+// Poststart, Poststop) carried in a container's OCI spec, giving
+// Singularity the same hook surface as runc/crun so that tools like
+// nvidia-container-runtime-hook and CNI-style network plugins work
+// unmodified.
+package hook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// State is marshaled to JSON and written to each hook's stdin, as
+// required by the OCI runtime spec.
+type State struct {
+	OCIVersion  string            `json:"ociVersion"`
+	ID          string            `json:"id"`
+	Status      string            `json:"status"`
+	Pid         int               `json:"pid,omitempty"`
+	Bundle      string            `json:"bundle"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// NewState builds the OCI state passed to hooks for the container
+// identified by id, currently in the given status, with bundle as its
+// working directory.
+func NewState(id, status, bundle string, pid int, annotations map[string]string) *State {
+	return &State{
+		OCIVersion:  specs.Version,
+		ID:          id,
+		Status:      status,
+		Pid:         pid,
+		Bundle:      bundle,
+		Annotations: annotations,
+	}
+}
+
+// Run executes each hook in hooks sequentially, feeding it state on
+// stdin and killing it if it doesn't return within its configured
+// timeout. It returns the first error encountered and stops running
+// further hooks in the list.
+func Run(hooks []specs.Hook, state *State) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal OCI state: %s", err)
+	}
+
+	for _, h := range hooks {
+		if err := runHook(h, state.Bundle, stateJSON); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runHook(h specs.Hook, bundle string, stateJSON []byte) error {
+	cmd := exec.Command(h.Path, h.Args...)
+	cmd.Dir = bundle
+	cmd.Env = h.Env
+	cmd.Stdin = bytes.NewReader(stateJSON)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start hook %s: %s", h.Path, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	if h.Timeout == nil {
+		if err := <-done; err != nil {
+			return fmt.Errorf("hook %s failed: %s", h.Path, err)
+		}
+		return nil
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("hook %s failed: %s", h.Path, err)
+		}
+		return nil
+	case <-time.After(time.Duration(*h.Timeout) * time.Second):
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("hook %s timed out after %d seconds", h.Path, *h.Timeout)
+	}
+}
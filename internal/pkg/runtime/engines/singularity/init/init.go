@@ -0,0 +1,101 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+// Package init factors the subreaper/signal-forwarding behavior of the
+// sinit shim out of StartProcess so it can be unit-tested independently
+// of a real container process.
+//
+// EngineConfig.GetInit() (mirroring the existing GetNoInit()) selects a
+// Mode that governs both how much of the shim runs at all and how it
+// behaves once running: ModeNone skips the shim loop entirely whenever
+// the fast, syscall.Exec path would otherwise be available, ModeSubreaper
+// runs a lightweight shim that only reaps orphaned descendants, and
+// ModeFull additionally forwards signals it receives to the container
+// process - that process is a distinct child of the shim even when it
+// is pid 1 of its own PID namespace, so nothing else would deliver a
+// host-sent signal to it.
+package init
+
+import "syscall"
+
+// Mode selects how much of the shim's init duties StartProcess takes
+// on for a container with its own PID namespace.
+type Mode string
+
+const (
+	// ModeNone disables the shim's init duties entirely: StartProcess
+	// takes the syscall.Exec fast path whenever nothing else forces a
+	// shim to run, and the container process is trusted to reap its
+	// own descendants and handle its own signals.
+	ModeNone Mode = "none"
+
+	// ModeSubreaper calls SetSubreaper before the container process is
+	// spawned, so descendants orphaned deeper in the container are
+	// adopted and reaped by the shim on SIGCHLD instead of becoming
+	// zombies, but does not forward signals to the container process.
+	ModeSubreaper Mode = "subreaper"
+
+	// ModeFull additionally forwards signals the shim receives to the
+	// container process (or its whole process group); it is the
+	// default when GetInit() reports no preference, matching prior
+	// behavior.
+	ModeFull Mode = "full"
+)
+
+// ParseMode maps the string stored in EngineConfig.GetInit() to a Mode,
+// defaulting to ModeFull (the historical, always-on behavior) for an
+// empty or unrecognized value.
+func ParseMode(s string) Mode {
+	switch Mode(s) {
+	case ModeNone, ModeSubreaper:
+		return Mode(s)
+	default:
+		return ModeFull
+	}
+}
+
+// SetSubreaper marks the calling process as a child subreaper via
+// prctl(PR_SET_CHILD_SUBREAPER, 1), so it adopts and reaps orphaned
+// descendants even when it is not pid 1 of its PID namespace.
+func SetSubreaper() error {
+	_, _, errno := syscall.Syscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// prSetChildSubreaper is PR_SET_CHILD_SUBREAPER, not exported by the
+// syscall package.
+const prSetChildSubreaper = 36
+
+// Reap drains every child that can be reaped without blocking,
+// invoking onReap for each one, until none are immediately ready. wait4
+// is expected to behave like syscall.Wait4(-1, &status, WNOHANG, nil):
+// it is injected so the SIGCHLD handler can be driven by a fake in
+// tests instead of real child processes.
+func Reap(wait4 func() (pid int, status syscall.WaitStatus, err error), onReap func(pid int, status syscall.WaitStatus)) {
+	for {
+		pid, status, err := wait4()
+		if pid <= 0 || err != nil {
+			return
+		}
+		if onReap != nil {
+			onReap(pid, status)
+		}
+	}
+}
+
+// ForwardTarget returns the kill(2) target to use when forwarding a
+// signal to the container process identified by pid: the negative of
+// pid (i.e. its whole process group) when pid is already a process
+// group leader, or pid itself otherwise. getpgid is injected so this
+// is testable without a real process.
+func ForwardTarget(pid int, getpgid func(pid int) (pgid int, err error)) int {
+	if pgid, err := getpgid(pid); err == nil && pgid == pid {
+		return -pid
+	}
+	return pid
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package init
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestReap(t *testing.T) {
+	// three children ready to be reaped, then nothing left
+	pending := []int{4242, 4243, 4244}
+
+	wait4 := func() (int, syscall.WaitStatus, error) {
+		if len(pending) == 0 {
+			return 0, 0, nil
+		}
+		pid := pending[0]
+		pending = pending[1:]
+		return pid, 0, nil
+	}
+
+	var reaped []int
+	Reap(wait4, func(pid int, status syscall.WaitStatus) {
+		reaped = append(reaped, pid)
+	})
+
+	if len(reaped) != 3 {
+		t.Fatalf("expected 3 reaped pids, got %d: %v", len(reaped), reaped)
+	}
+	for i, pid := range []int{4242, 4243, 4244} {
+		if reaped[i] != pid {
+			t.Errorf("reaped[%d] = %d, want %d", i, reaped[i], pid)
+		}
+	}
+}
+
+func TestReapStopsOnError(t *testing.T) {
+	calls := 0
+	wait4 := func() (int, syscall.WaitStatus, error) {
+		calls++
+		return 0, 0, syscall.ECHILD
+	}
+
+	var reaped []int
+	Reap(wait4, func(pid int, status syscall.WaitStatus) {
+		reaped = append(reaped, pid)
+	})
+
+	if calls != 1 {
+		t.Fatalf("expected wait4 to be called once, got %d", calls)
+	}
+	if len(reaped) != 0 {
+		t.Fatalf("expected no reaps, got %v", reaped)
+	}
+}
+
+func TestForwardTargetProcessGroupLeader(t *testing.T) {
+	getpgid := func(pid int) (int, error) { return pid, nil }
+
+	if got := ForwardTarget(1234, getpgid); got != -1234 {
+		t.Errorf("ForwardTarget() = %d, want -1234", got)
+	}
+}
+
+func TestForwardTargetNotGroupLeader(t *testing.T) {
+	getpgid := func(pid int) (int, error) { return 1, nil }
+
+	if got := ForwardTarget(1234, getpgid); got != 1234 {
+		t.Errorf("ForwardTarget() = %d, want 1234", got)
+	}
+}
+
+func TestForwardTargetGetpgidError(t *testing.T) {
+	getpgid := func(pid int) (int, error) { return 0, syscall.ESRCH }
+
+	if got := ForwardTarget(1234, getpgid); got != 1234 {
+		t.Errorf("ForwardTarget() = %d, want 1234 when getpgid fails", got)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Mode
+	}{
+		{"none", ModeNone},
+		{"subreaper", ModeSubreaper},
+		{"full", ModeFull},
+		{"", ModeFull},
+		{"bogus", ModeFull},
+	}
+
+	for _, c := range cases {
+		if got := ParseMode(c.in); got != c.want {
+			t.Errorf("ParseMode(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
@@ -6,12 +6,15 @@
 package singularity
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"syscall"
@@ -24,6 +27,10 @@ import (
 
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sylabs/singularity/internal/pkg/instance"
+	"github.com/sylabs/singularity/internal/pkg/runtime/engines/singularity/console"
+	"github.com/sylabs/singularity/internal/pkg/runtime/engines/singularity/hook"
+	shiminit "github.com/sylabs/singularity/internal/pkg/runtime/engines/singularity/init"
+	"github.com/sylabs/singularity/internal/pkg/runtime/engines/singularity/shim"
 	"github.com/sylabs/singularity/internal/pkg/sylog"
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -163,11 +170,13 @@ func (engine *EngineOperations) StartProcess(masterConn net.Conn) error {
 	args := engine.EngineConfig.OciConfig.Process.Args
 	env := engine.EngineConfig.OciConfig.Process.Env
 
+	initMode := shiminit.ParseMode(engine.EngineConfig.GetInit())
+
 	if engine.EngineConfig.OciConfig.Linux != nil {
 		namespaces := engine.EngineConfig.OciConfig.Linux.Namespaces
 		for _, ns := range namespaces {
 			if ns.Type == specs.PIDNamespace {
-				if !engine.EngineConfig.GetNoInit() {
+				if !engine.EngineConfig.GetNoInit() && initMode != shiminit.ModeNone {
 					shimProcess = true
 				}
 				break
@@ -202,15 +211,44 @@ func (engine *EngineOperations) StartProcess(masterConn net.Conn) error {
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
 	cmd.Env = env
+	// run the container process in its own process group so that a
+	// forwarded signal can be delivered to it (and anything it spawns)
+	// via kill(-pgid, sig) without also hitting the shim
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	var term *console.Console
+	if engine.EngineConfig.OciConfig.Process != nil && engine.EngineConfig.OciConfig.Process.Terminal {
+		var err error
+		term, err = console.New()
+		if err != nil {
+			return fmt.Errorf("failed to allocate console: %s", err)
+		}
+		cmd.Stdin = term.Slave
+		cmd.Stdout = term.Slave
+		cmd.Stderr = term.Slave
+		cmd.SysProcAttr.Setsid = true
+		cmd.SysProcAttr.Setctty = true
+	}
 
-	var status syscall.WaitStatus
 	errChan := make(chan error, 1)
 	signals := make(chan os.Signal, 1)
 
+	// shimProcess already implies initMode != ModeNone (see above)
+	if shimProcess {
+		if err := shiminit.SetSubreaper(); err != nil {
+			sylog.Warningf("failed to set child subreaper: %s", err)
+		}
+	}
+
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("exec %s failed: %s", args[0], err)
 	}
 
+	if term != nil {
+		// the child now holds its own reference to the slave side
+		term.Slave.Close()
+	}
+
 	go func() {
 		errChan <- cmd.Wait()
 	}()
@@ -234,6 +272,76 @@ func (engine *EngineOperations) StartProcess(masterConn net.Conn) error {
 		return syscall.Errno(err)
 	}
 
+	// For instances, expose a gRPC control API over a per-instance unix
+	// socket so that e.g. `instance exec`/`instance logs` can interact
+	// with the running container instead of relying solely on kill(2)
+	// and /proc.
+	var shimServer *shim.Server
+	var attachListener net.Listener
+	if isInstance {
+		shimServer = shim.New(cmd.Process.Pid, engine.CommonConfig.ContainerID, ociSpecDigest(&engine.EngineConfig.OciConfig.Spec))
+
+		if term != nil {
+			// must be set before Listen: once the control socket is
+			// accepting connections, a ResizePty call can race in
+			// before the console is recorded otherwise
+			shimServer.SetConsole(term.Master)
+		}
+
+		sockPath := shim.SocketPath(engine.CommonConfig.ContainerID)
+		if err := os.MkdirAll(filepath.Dir(sockPath), 0700); err != nil {
+			return fmt.Errorf("failed to create control socket directory: %s", err)
+		}
+		if err := shimServer.Listen(sockPath); err != nil {
+			return fmt.Errorf("failed to start shim control server: %s", err)
+		}
+
+		if term != nil {
+			// record a reopenable path to the master so a later, separate
+			// `instance attach` invocation can recover it
+			consolePath := shim.ConsolePath(engine.CommonConfig.ContainerID)
+			target := fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), term.Master.Fd())
+			if err := os.Symlink(target, consolePath); err != nil && !os.IsExist(err) {
+				sylog.Debugf("failed to persist console path: %s", err)
+			}
+
+			attachPath := shim.AttachSocketPath(engine.CommonConfig.ContainerID)
+			if err := os.Remove(attachPath); err != nil && !os.IsNotExist(err) {
+				sylog.Debugf("failed to remove stale attach socket %s: %s", attachPath, err)
+			}
+			if l, err := net.Listen("unix", attachPath); err != nil {
+				sylog.Debugf("failed to listen on attach socket: %s", err)
+			} else {
+				attachListener = l
+				go func() {
+					for {
+						conn, err := l.Accept()
+						if err != nil {
+							return
+						}
+						go console.Proxy(term.Master, conn)
+					}
+				}()
+			}
+		}
+	}
+
+	// teardown tears down the shim control socket and console allocated
+	// for this container, if any; it must run before every exit path.
+	teardown := func() {
+		if shimServer != nil {
+			shimServer.Close()
+		}
+		if attachListener != nil {
+			attachListener.Close()
+			os.Remove(shim.AttachSocketPath(engine.CommonConfig.ContainerID))
+		}
+		if term != nil {
+			term.Close()
+			os.Remove(shim.ConsolePath(engine.CommonConfig.ContainerID))
+		}
+	}
+
 	// Manage all signals
 	signal.Notify(signals)
 
@@ -247,29 +355,73 @@ func (engine *EngineOperations) StartProcess(masterConn net.Conn) error {
 			sylog.Debugf("Received signal %s", s.String())
 			switch s {
 			case syscall.SIGCHLD:
-				for {
-					wpid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
-					if wpid <= 0 || err != nil {
-						break
+				if initMode != shiminit.ModeNone {
+					shiminit.Reap(func() (int, syscall.WaitStatus, error) {
+						var st syscall.WaitStatus
+						wpid, err := syscall.Wait4(-1, &st, syscall.WNOHANG, nil)
+						return wpid, st, err
+					}, nil)
+				}
+			case syscall.SIGWINCH:
+				// propagate our own controlling terminal's size to the
+				// container console when we are attached in the foreground
+				if term != nil {
+					if ws, err := console.GetWinsize(os.Stdin.Fd()); err == nil {
+						if err := console.SetWinsize(term.Master.Fd(), ws); err != nil {
+							sylog.Debugf("failed to resize console: %s", err)
+						}
 					}
 				}
 			default:
 				lastSignal = s.(syscall.Signal)
+
+				// SIGSEGV can't be handled meaningfully: let it take the
+				// shim down rather than try to keep running. (SIGKILL
+				// would be another candidate here, but the kernel never
+				// lets a process catch it, so signal.Notify can never
+				// actually deliver it to this select.)
+				if lastSignal == syscall.SIGSEGV {
+					sylog.Debugf("Terminating shim on signal %s", lastSignal.String())
+					teardown()
+					syscall.Kill(os.Getpid(), syscall.SIGKILL)
+					continue
+				}
+
+				// ModeNone/ModeSubreaper only want the shim around for
+				// reaping and/or the control API, not to relay signals:
+				// the container process is expected to handle its own
+				// job control in that case. Only ModeFull forwards.
+				if initMode != shiminit.ModeFull {
+					continue
+				}
+
+				// the container process always runs as a separate child of
+				// this shim, even when it is pid 1 of its own PID namespace
 				if isInstance {
 					if err := syscall.Kill(-1, lastSignal); err == syscall.ESRCH {
 						sylog.Debugf("No child process, exiting ...")
+						teardown()
 						os.Exit(128 + int(lastSignal))
 					}
 				} else {
-					// kill ourself with SIGKILL whatever signal was received
-					syscall.Kill(syscall.Gettid(), syscall.SIGKILL)
+					// forward to the container's process group so it (and
+					// anything it spawned) gets a chance to handle the
+					// signal; we only exit once errChan reports it reaped
+					target := shiminit.ForwardTarget(cmd.Process.Pid, syscall.Getpgid)
+					if err := syscall.Kill(target, lastSignal); err == syscall.ESRCH {
+						sylog.Debugf("No child process, waiting for it to be reaped ...")
+					}
 				}
 			}
 		case err := <-errChan:
 			if e, ok := err.(*exec.ExitError); ok {
 				if status, ok := e.Sys().(syscall.WaitStatus); ok {
+					if shimServer != nil {
+						shimServer.NotifyExit(status)
+					}
+					teardown()
 					if status.Signaled() {
-						syscall.Kill(syscall.Gettid(), syscall.SIGKILL)
+						os.Exit(128 + int(status.Signal()))
 					}
 					os.Exit(status.ExitStatus())
 				}
@@ -280,88 +432,190 @@ func (engine *EngineOperations) StartProcess(masterConn net.Conn) error {
 				// container process execution has been interrupted by signal
 				if e.Err.(syscall.Errno) == syscall.ECHILD {
 					sylog.Debugf("No child processes, exiting ...")
+					teardown()
 					os.Exit(128 + int(lastSignal))
 				}
 			}
 			if !isInstance {
+				teardown()
 				os.Exit(0)
 			}
 		}
 	}
 }
 
+// ociSpecDigest returns a stable content digest for spec, reported by
+// the shim control API so callers can tell whether a running instance
+// still matches the OCI spec it was started from.
+func ociSpecDigest(spec *specs.Spec) string {
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
 // PostStartProcess will execute code in smaster context after execution of container
-// process, typically to write instance state/config files or execute post start OCI hook
+// process, typically to write instance state/config files and execute the
+// OCI Poststart hook.
 func (engine *EngineOperations) PostStartProcess(pid int) error {
 	sylog.Debugf("Post start process")
 
 	if engine.EngineConfig.GetInstance() {
-		uid := os.Getuid()
-		gid := os.Getgid()
-		name := engine.CommonConfig.ContainerID
-		privileged := true
-
-		if err := os.Chdir("/"); err != nil {
-			return fmt.Errorf("failed to change directory to /: %s", err)
+		if err := engine.writeInstanceFile(pid); err != nil {
+			return err
 		}
+	}
 
-		if engine.EngineConfig.OciConfig.Linux != nil {
-			for _, ns := range engine.EngineConfig.OciConfig.Linux.Namespaces {
-				if ns.Type == specs.UserNamespace {
-					privileged = false
-					break
-				}
-			}
-		}
+	if err := engine.runPoststartHook(pid); err != nil {
+		return fmt.Errorf("poststart hook failed: %s", err)
+	}
 
-		file, err := instance.Add(name, privileged)
-		if err != nil {
-			return err
-		}
+	return nil
+}
 
-		file.Config, err = json.Marshal(engine.CommonConfig)
-		if err != nil {
-			return err
-		}
+// PostStopProcess executes the OCI Poststop hook once the container
+// process has exited. Unlike Prestart/Poststart, a failing Poststop
+// hook is only logged: the container is already gone and there is
+// nothing left to abort.
+func (engine *EngineOperations) PostStopProcess(pid int) error {
+	sylog.Debugf("Post stop process")
 
-		pw, err := user.GetPwUID(uint32(uid))
-		if err != nil {
-			return err
-		}
-		file.User = pw.Name
-		file.Pid = pid
-		file.PPid = os.Getpid()
-		file.Image = engine.EngineConfig.GetImage()
-
-		if privileged {
-			var err error
-
-			mainthread.Execute(func() {
-				if err = syscall.Setresuid(0, 0, uid); err != nil {
-					err = fmt.Errorf("failed to escalate uid privileges")
-					return
-				}
-				if err = syscall.Setresgid(0, 0, gid); err != nil {
-					err = fmt.Errorf("failed to escalate gid privileges")
-					return
-				}
-				if err = file.Update(); err != nil {
-					return
-				}
-				if err = syscall.Setresgid(gid, gid, 0); err != nil {
-					err = fmt.Errorf("failed to escalate gid privileges")
-					return
-				}
-				if err := syscall.Setresuid(uid, uid, 0); err != nil {
-					err = fmt.Errorf("failed to escalate uid privileges")
-					return
-				}
-			})
+	hooks := engine.EngineConfig.OciConfig.Hooks
+	if hooks == nil || len(hooks.Poststop) == 0 {
+		return nil
+	}
 
-			return err
-		}
+	state := hook.NewState(
+		engine.CommonConfig.ContainerID,
+		"stopped",
+		engine.EngineConfig.GetImage(),
+		pid,
+		engine.EngineConfig.OciConfig.Annotations,
+	)
+
+	if err := hook.Run(hooks.Poststop, state); err != nil {
+		sylog.Warningf("poststop hook failed: %s", err)
+	}
+
+	return nil
+}
+
+// CreateContainer executes the OCI Prestart hook, if any, once the
+// container's namespaces (including its network namespace) have been
+// joined but before pivot_root runs, giving tools like
+// nvidia-container-runtime-hook and CNI-style network plugins the same
+// hook surface runc/crun provide.
+func (engine *EngineOperations) CreateContainer(pid int) error {
+	sylog.Debugf("Create container")
+
+	hooks := engine.EngineConfig.OciConfig.Hooks
+	if hooks == nil || len(hooks.Prestart) == 0 {
+		return nil
+	}
+
+	state := hook.NewState(
+		engine.CommonConfig.ContainerID,
+		"creating",
+		engine.EngineConfig.GetImage(),
+		pid,
+		engine.EngineConfig.OciConfig.Annotations,
+	)
 
-		return file.Update()
+	if err := hook.Run(hooks.Prestart, state); err != nil {
+		return fmt.Errorf("prestart hook failed: %s", err)
 	}
+
 	return nil
 }
+
+// runPoststartHook executes the OCI Poststart hook, if any, in the host
+// mount namespace once the container process has started.
+func (engine *EngineOperations) runPoststartHook(pid int) error {
+	hooks := engine.EngineConfig.OciConfig.Hooks
+	if hooks == nil || len(hooks.Poststart) == 0 {
+		return nil
+	}
+
+	state := hook.NewState(
+		engine.CommonConfig.ContainerID,
+		"running",
+		engine.EngineConfig.GetImage(),
+		pid,
+		engine.EngineConfig.OciConfig.Annotations,
+	)
+
+	return hook.Run(hooks.Poststart, state)
+}
+
+// writeInstanceFile persists the instance state/config files under
+// /var/run/singularity/instances for a running instance.
+func (engine *EngineOperations) writeInstanceFile(pid int) error {
+	uid := os.Getuid()
+	gid := os.Getgid()
+	name := engine.CommonConfig.ContainerID
+	privileged := true
+
+	if err := os.Chdir("/"); err != nil {
+		return fmt.Errorf("failed to change directory to /: %s", err)
+	}
+
+	if engine.EngineConfig.OciConfig.Linux != nil {
+		for _, ns := range engine.EngineConfig.OciConfig.Linux.Namespaces {
+			if ns.Type == specs.UserNamespace {
+				privileged = false
+				break
+			}
+		}
+	}
+
+	file, err := instance.Add(name, privileged)
+	if err != nil {
+		return err
+	}
+
+	file.Config, err = json.Marshal(engine.CommonConfig)
+	if err != nil {
+		return err
+	}
+
+	pw, err := user.GetPwUID(uint32(uid))
+	if err != nil {
+		return err
+	}
+	file.User = pw.Name
+	file.Pid = pid
+	file.PPid = os.Getpid()
+	file.Image = engine.EngineConfig.GetImage()
+
+	if privileged {
+		var err error
+
+		mainthread.Execute(func() {
+			if err = syscall.Setresuid(0, 0, uid); err != nil {
+				err = fmt.Errorf("failed to escalate uid privileges")
+				return
+			}
+			if err = syscall.Setresgid(0, 0, gid); err != nil {
+				err = fmt.Errorf("failed to escalate gid privileges")
+				return
+			}
+			if err = file.Update(); err != nil {
+				return
+			}
+			if err = syscall.Setresgid(gid, gid, 0); err != nil {
+				err = fmt.Errorf("failed to escalate gid privileges")
+				return
+			}
+			if err := syscall.Setresuid(uid, uid, 0); err != nil {
+				err = fmt.Errorf("failed to escalate uid privileges")
+				return
+			}
+		})
+
+		return err
+	}
+
+	return file.Update()
+}
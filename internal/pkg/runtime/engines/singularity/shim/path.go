@@ -0,0 +1,52 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package shim
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// instanceDir is where the shim keeps its sidecar files for a running
+// instance, alongside the existing instance.File JSON under
+// /var/run/singularity/instances.
+const instanceDir = "/var/run/singularity/instances"
+
+// dir returns the per-instance directory for the calling user.
+func dir(name string) string {
+	return filepath.Join(instanceDir, fmt.Sprintf("%d", os.Getuid()), name)
+}
+
+// SocketPath returns the control socket path for the named instance.
+// It is exported so that clients like `instance exec` can dial the
+// same path the shim listens on.
+func SocketPath(name string) string {
+	return filepath.Join(dir(name), "control.sock")
+}
+
+// AttachSocketPath returns the console attach socket path for the
+// named instance, used to proxy the container's pty to/from a detached
+// `instance attach`.
+func AttachSocketPath(name string) string {
+	return filepath.Join(dir(name), "attach.sock")
+}
+
+// ConsolePath returns the path of the file the shim writes the
+// container console's reopenable path to (a /proc/<pid>/fd/<n> symlink
+// target), so a later `instance attach` can recover the master side of
+// the pty even when run from a different process.
+func ConsolePath(name string) string {
+	return filepath.Join(dir(name), "console")
+}
+
+// ExecFdSocketPath returns the ephemeral socket path Exec listens on to
+// hand the stdio fds of the process it spawned back to the caller
+// named in ExecResponse.FdSocket, identified by id so concurrent Exec
+// calls against the same instance don't collide.
+func ExecFdSocketPath(name string, id uint64) string {
+	return filepath.Join(dir(name), fmt.Sprintf("exec-%d.sock", id))
+}
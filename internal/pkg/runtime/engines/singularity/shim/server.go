@@ -0,0 +1,488 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+// Package shim implements the gRPC control API exposed by sinit for a
+// running instance, mirroring the per-container API containerd-shim
+// exposes to its supervising daemon. It lets callers such as
+// `singularity instance exec` talk to a running container over a
+// per-instance unix socket instead of poking /proc or relying solely on
+// kill(2).
+package shim
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sylabs/singularity/internal/pkg/runtime/engines/singularity/console"
+	"github.com/sylabs/singularity/internal/pkg/sylog"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+)
+
+// Server implements ShimServer on top of the container process managed
+// by sinit. Exactly one Server exists per shim.
+type Server struct {
+	mu sync.Mutex
+
+	sockPath   string
+	listener   net.Listener
+	grpcServer *grpc.Server
+
+	containerID   string
+	pid           int
+	startedAt     time.Time
+	ociSpecDigest string
+
+	exited     bool
+	exitStatus int
+
+	consoleMaster *os.File
+
+	subscribers map[chan *Event]struct{}
+
+	execCounter uint64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// SetConsole records the master side of the container's pty so
+// ResizePty can act on it. It must be called before Listen if the
+// container was started with a terminal.
+func (s *Server) SetConsole(master *os.File) {
+	s.mu.Lock()
+	s.consoleMaster = master
+	s.mu.Unlock()
+}
+
+// New creates a Server for the container process identified by pid,
+// recording its start time and the digest of the OCI spec it was
+// started from so State can report them to clients. containerID is
+// used to place the per-instance fd sockets Exec listens on.
+func New(pid int, containerID, ociSpecDigest string) *Server {
+	return &Server{
+		containerID:   containerID,
+		pid:           pid,
+		startedAt:     time.Now(),
+		ociSpecDigest: ociSpecDigest,
+		subscribers:   make(map[chan *Event]struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// Listen creates the per-instance control socket at path, removing any
+// stale socket left behind by a previous run, and starts serving the
+// Shim service on it in a new goroutine. The caller is responsible for
+// calling Close when the container exits.
+func (s *Server) Listen(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale control socket %s: %s", path, err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket %s: %s", path, err)
+	}
+
+	gs := grpc.NewServer()
+	RegisterShimServer(gs, s)
+
+	s.sockPath = path
+	s.listener = l
+	s.grpcServer = gs
+
+	go func() {
+		if err := gs.Serve(l); err != nil {
+			sylog.Debugf("shim control server on %s stopped: %s", path, err)
+		}
+	}()
+
+	return nil
+}
+
+// Close stops serving the control API and removes the socket. It is
+// safe to call multiple times and safe to call when Listen was never
+// called.
+//
+// It closes done before calling GracefulStop: Events is a long-lived
+// streaming RPC that would otherwise only return once its stream
+// context is cancelled, which never happens on its own, so a
+// subscribed client would block Close forever. Watching done lets
+// Events flush any already-queued events (notably the EXIT NotifyExit
+// enqueues right before teardown calls Close) and return promptly
+// instead.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+
+	s.mu.Lock()
+	gs := s.grpcServer
+	path := s.sockPath
+	s.mu.Unlock()
+
+	if gs != nil {
+		gs.GracefulStop()
+	}
+	if path != "" {
+		os.Remove(path)
+	}
+}
+
+// NotifyExit records the container process' final status and fans an
+// EXIT event out to any Events subscribers. It must be called exactly
+// once, from the same goroutine that reaps the container process.
+func (s *Server) NotifyExit(status syscall.WaitStatus) {
+	s.mu.Lock()
+	s.exited = true
+	if status.Signaled() {
+		s.exitStatus = 128 + int(status.Signal())
+	} else {
+		s.exitStatus = status.ExitStatus()
+	}
+	exitStatus := s.exitStatus
+	s.mu.Unlock()
+
+	s.broadcast(&Event{
+		Type:       Event_EXIT,
+		Pid:        int32(s.pid),
+		ExitStatus: int32(exitStatus),
+	})
+}
+
+func (s *Server) broadcast(ev *Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			sylog.Debugf("dropping event for slow shim control subscriber")
+		}
+	}
+}
+
+// State implements ShimServer.
+func (s *Server) State(ctx context.Context, req *StateRequest) (*StateResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &StateResponse{
+		Pid:           int32(s.pid),
+		Exited:        s.exited,
+		ExitStatus:    int32(s.exitStatus),
+		StartedAt:     s.startedAt.Format(time.RFC3339),
+		OciSpecDigest: s.ociSpecDigest,
+	}, nil
+}
+
+// Kill implements ShimServer, forwarding the requested signal to the
+// container process, or to its whole process group when All is set.
+func (s *Server) Kill(ctx context.Context, req *KillRequest) (*KillResponse, error) {
+	s.mu.Lock()
+	pid := s.pid
+	s.mu.Unlock()
+
+	target := pid
+	if req.All {
+		target = -pid
+	}
+
+	if err := syscall.Kill(target, syscall.Signal(req.Signal)); err != nil {
+		return nil, fmt.Errorf("failed to send signal %d to %d: %s", req.Signal, target, err)
+	}
+
+	return &KillResponse{}, nil
+}
+
+// execNamespaces lists the namespace types Exec joins before spawning
+// the requested process, in the order nsenter(1) uses: the mount
+// namespace last, since the fds for the others must be opened (below)
+// against our own, unchanged mount namespace first, and the pid
+// namespace is included because setns on it only affects children
+// forked afterwards, which is exactly what cmd.Start does here. The
+// user namespace, when the container has one of its own, is handled
+// separately by joinUserNamespace and entered before any of these,
+// since doing so can change the privileges needed to join the rest.
+var execNamespaces = []string{"ipc", "uts", "net", "pid", "mnt"}
+
+// execPathMu serializes the PATH swap Exec does around exec.Command's
+// lookup of req.Args[0]: PATH is a process-wide environment variable,
+// so without this, concurrent Exec calls with different Env could each
+// see the other's PATH for their lookup.
+var execPathMu sync.Mutex
+
+// joinUserNamespace setns(2)s the calling goroutine into the user
+// namespace of pid if it differs from the caller's own, returning the
+// opened namespace file for the caller to close once done with it. It
+// is a no-op, returning a nil file, when pid shares the caller's user
+// namespace, which is the common case for privileged containers.
+func joinUserNamespace(pid int) (*os.File, error) {
+	target, err := os.Open(fmt.Sprintf("/proc/%d/ns/user", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open user namespace of pid %d: %s", pid, err)
+	}
+
+	self, err := os.Open("/proc/self/ns/user")
+	if err != nil {
+		target.Close()
+		return nil, fmt.Errorf("failed to open own user namespace: %s", err)
+	}
+	defer self.Close()
+
+	targetInfo, err := target.Stat()
+	if err != nil {
+		target.Close()
+		return nil, fmt.Errorf("failed to stat user namespace of pid %d: %s", pid, err)
+	}
+	selfInfo, err := self.Stat()
+	if err != nil {
+		target.Close()
+		return nil, fmt.Errorf("failed to stat own user namespace: %s", err)
+	}
+	if os.SameFile(targetInfo, selfInfo) {
+		target.Close()
+		return nil, nil
+	}
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWUSER); err != nil {
+		target.Close()
+		return nil, fmt.Errorf("failed to join user namespace of pid %d: %s", pid, err)
+	}
+
+	return target, nil
+}
+
+// Exec implements ShimServer. It joins the namespaces of the container
+// process and spawns req.Args[0] inside them, then hands its stdio (or
+// pty master, if Terminal is set) back to whoever dials the socket
+// returned as ExecResponse.FdSocket.
+func (s *Server) Exec(ctx context.Context, req *ExecRequest) (*ExecResponse, error) {
+	if len(req.Args) == 0 {
+		return nil, fmt.Errorf("no command given")
+	}
+
+	s.mu.Lock()
+	pid := s.pid
+	containerID := s.containerID
+	s.mu.Unlock()
+
+	nsFiles := make(map[string]*os.File, len(execNamespaces))
+	for _, ns := range execNamespaces {
+		f, err := os.Open(fmt.Sprintf("/proc/%d/ns/%s", pid, ns))
+		if err != nil {
+			for _, opened := range nsFiles {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("failed to open %s namespace of pid %d: %s", ns, pid, err)
+		}
+		nsFiles[ns] = f
+	}
+	defer func() {
+		for _, f := range nsFiles {
+			f.Close()
+		}
+	}()
+
+	// callerFiles holds the ends of the stdio (or pty master) handed
+	// back to the caller: they are kept referenced here until sendFds
+	// has transmitted them, since letting them become unreachable
+	// earlier would let the garbage collector finalize - and close -
+	// the underlying fds first. childFiles holds the other ends, which
+	// the child takes its own reference to once started.
+	var callerFiles, childFiles []*os.File
+	var stdin, stdout, stderr *os.File
+	var sysProcAttr *syscall.SysProcAttr
+	if req.Terminal {
+		term, err := console.New()
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate console for exec: %s", err)
+		}
+		stdin, stdout, stderr = term.Slave, term.Slave, term.Slave
+		sysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+		callerFiles = []*os.File{term.Master}
+		childFiles = []*os.File{term.Slave}
+	} else {
+		stdinR, stdinW, err := os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate exec stdin: %s", err)
+		}
+		stdoutR, stdoutW, err := os.Pipe()
+		if err != nil {
+			closeFiles(stdinR, stdinW)
+			return nil, fmt.Errorf("failed to allocate exec stdout: %s", err)
+		}
+		stderrR, stderrW, err := os.Pipe()
+		if err != nil {
+			closeFiles(stdinR, stdinW, stdoutR, stdoutW)
+			return nil, fmt.Errorf("failed to allocate exec stderr: %s", err)
+		}
+		stdin, stdout, stderr = stdinR, stdoutW, stderrW
+		callerFiles = []*os.File{stdinW, stdoutR, stderrR}
+		childFiles = []*os.File{stdinR, stdoutW, stderrW}
+	}
+
+	// Join the container's namespaces on this OS thread immediately
+	// before forking, so only the fork - not the rest of this shim -
+	// ends up inside them. This thread is never unlocked afterwards:
+	// returning it to the scheduler's pool with its namespaces changed
+	// would leak them into whatever unrelated goroutine runs on it
+	// next, so it is deliberately left locked and torn down with this
+	// goroutine once Exec returns.
+	runtime.LockOSThread()
+
+	userNsFile, err := joinUserNamespace(pid)
+	if err != nil {
+		closeFiles(callerFiles...)
+		closeFiles(childFiles...)
+		return nil, err
+	}
+	if userNsFile != nil {
+		defer userNsFile.Close()
+	}
+
+	for _, ns := range execNamespaces {
+		if err := unix.Setns(int(nsFiles[ns].Fd()), 0); err != nil {
+			closeFiles(callerFiles...)
+			closeFiles(childFiles...)
+			return nil, fmt.Errorf("failed to join %s namespace of pid %d: %s", ns, pid, err)
+		}
+	}
+
+	// exec.Command resolves a bare req.Args[0] against PATH immediately,
+	// so it must not be constructed until after the mount namespace
+	// above is joined, and must see the container's PATH rather than
+	// the shim's own: swap it in only for the lookup, matching
+	// checkExec's approach in process.go for the same problem. The swap
+	// is serialized since PATH is process-wide and Exec can run
+	// concurrently for different callers.
+	execPathMu.Lock()
+	oldPath := os.Getenv("PATH")
+	for _, keyval := range req.Env {
+		if strings.HasPrefix(keyval, "PATH=") {
+			os.Setenv("PATH", keyval[5:])
+			break
+		}
+	}
+	cmd := exec.Command(req.Args[0], req.Args[1:]...)
+	os.Setenv("PATH", oldPath)
+	execPathMu.Unlock()
+
+	cmd.Env = req.Env
+	if req.Cwd != "" {
+		cmd.Dir = req.Cwd
+	}
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.SysProcAttr = sysProcAttr
+
+	if err := cmd.Start(); err != nil {
+		closeFiles(callerFiles...)
+		closeFiles(childFiles...)
+		return nil, fmt.Errorf("failed to exec %s: %s", req.Args[0], err)
+	}
+
+	// the child now holds its own reference to these
+	closeFiles(childFiles...)
+
+	execID := atomic.AddUint64(&s.execCounter, 1)
+	fdSocket := ExecFdSocketPath(containerID, execID)
+
+	callerFds := make([]int, len(callerFiles))
+	for i, f := range callerFiles {
+		callerFds[i] = int(f.Fd())
+	}
+
+	go func() {
+		if err := sendFds(fdSocket, callerFds); err != nil {
+			sylog.Debugf("failed to send exec fds for pid %d: %s", cmd.Process.Pid, err)
+		}
+		closeFiles(callerFiles...)
+		cmd.Wait()
+	}()
+
+	return &ExecResponse{Pid: int32(cmd.Process.Pid), FdSocket: fdSocket}, nil
+}
+
+func closeFiles(files ...*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// ResizePty implements ShimServer, applying the requested window size
+// to the master side of the container's pty.
+func (s *Server) ResizePty(ctx context.Context, req *ResizePtyRequest) (*ResizePtyResponse, error) {
+	s.mu.Lock()
+	master := s.consoleMaster
+	s.mu.Unlock()
+
+	if master == nil {
+		return nil, fmt.Errorf("instance was not started with a terminal")
+	}
+
+	ws := &console.Winsize{Row: uint16(req.Height), Col: uint16(req.Width)}
+	if err := console.SetWinsize(master.Fd(), ws); err != nil {
+		return nil, fmt.Errorf("failed to resize console: %s", err)
+	}
+
+	return &ResizePtyResponse{}, nil
+}
+
+// Events implements ShimServer, streaming lifecycle events to the
+// caller until the stream context is cancelled or the shim tears down.
+func (s *Server) Events(req *EventsRequest, stream Shim_EventsServer) error {
+	ch := make(chan *Event, 16)
+
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case ev := <-ch:
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-s.done:
+			// the shim is tearing down: flush whatever is already
+			// queued (e.g. the final EXIT from NotifyExit) before
+			// returning, so Close's GracefulStop doesn't wait on a
+			// stream that would otherwise never exit on its own
+			for {
+				select {
+				case ev := <-ch:
+					if err := stream.Send(ev); err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// Delete implements ShimServer, tearing down the control socket.
+func (s *Server) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	go s.Close()
+	return &DeleteResponse{}, nil
+}
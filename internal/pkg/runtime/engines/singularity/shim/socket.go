@@ -0,0 +1,102 @@
+// Copyright (c) 2019, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package shim
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// execFdSocketTimeout bounds how long sendFds waits for the caller
+// named in ExecResponse.FdSocket to dial in. Without it, a caller that
+// crashes or simply never dials would leave Exec's goroutine parked in
+// Accept forever, holding its spawned process unreaped.
+const execFdSocketTimeout = 30 * time.Second
+
+// sendFds listens on the unix socket at path, accepts a single
+// connection and sends fds as ancillary data over SCM_RIGHTS to
+// whoever dials in, then removes the socket. It is the server side
+// counterpart to RecvFds, used by Exec to hand the stdio of the
+// process it spawned back to the caller named in ExecResponse.FdSocket.
+func sendFds(path string, fds []int) error {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on fd socket %s: %s", path, err)
+	}
+	defer l.Close()
+	defer os.Remove(path)
+
+	if err := l.(*net.UnixListener).SetDeadline(time.Now().Add(execFdSocketTimeout)); err != nil {
+		return fmt.Errorf("failed to set deadline on fd socket %s: %s", path, err)
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		return fmt.Errorf("failed to accept connection on %s: %s", path, err)
+	}
+	defer conn.Close()
+
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("%s is not a unix socket connection", path)
+	}
+
+	if err := uc.SetDeadline(time.Now().Add(execFdSocketTimeout)); err != nil {
+		return fmt.Errorf("failed to set deadline on fd socket %s: %s", path, err)
+	}
+
+	rights := unix.UnixRights(fds...)
+	if _, _, err := uc.WriteMsgUnix([]byte{0}, rights, nil); err != nil {
+		return fmt.Errorf("failed to send fds over %s: %s", path, err)
+	}
+
+	return nil
+}
+
+// RecvFds dials the unix socket at path and returns the fds sent over
+// SCM_RIGHTS by sendFds. It is the client side counterpart used by
+// `instance exec` to receive the stdio of a process started by Exec.
+func RecvFds(path string) ([]*os.File, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial fd socket %s: %s", path, err)
+	}
+	defer conn.Close()
+
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a unix socket connection", path)
+	}
+
+	oob := make([]byte, unix.CmsgSpace(3*4))
+	buf := make([]byte, 1)
+	_, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fds from %s: %s", path, err)
+	}
+
+	scms, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse control message: %s", err)
+	}
+
+	var files []*os.File
+	for _, scm := range scms {
+		rawFds, err := unix.ParseUnixRights(&scm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse unix rights: %s", err)
+		}
+		for _, fd := range rawFds {
+			files = append(files, os.NewFile(uintptr(fd), "exec-fd"))
+		}
+	}
+
+	return files, nil
+}